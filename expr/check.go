@@ -0,0 +1,129 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/StackExchange/tsaf/expr/parse"
+)
+
+// TypeError describes a static type mismatch found by Expr.Check, along
+// with the position in the source expression where it occurred.
+type TypeError struct {
+	Pos parse.Pos
+	Msg string
+}
+
+func (t *TypeError) Error() string {
+	return fmt.Sprintf("expr: %s at %s", t.Msg, t.Pos)
+}
+
+// Check walks e's parse tree once and statically verifies that every
+// binary, unary, and function node is given operand types it knows how to
+// evaluate. It catches the mismatches that would otherwise panic inside
+// walkBinary/walkFunc/walkUnary at Execute time, so a bad alert expression
+// fails at parse time instead of whenever it finally matches data.
+func (e *Expr) Check() error {
+	return check(e.Tree.Root)
+}
+
+func check(node parse.Node) error {
+	switch node := node.(type) {
+	case *parse.NumberNode, *parse.StringNode:
+		return nil
+	case *parse.BinaryNode:
+		return checkBinary(node)
+	case *parse.UnaryNode:
+		return checkUnary(node)
+	case *parse.FuncNode:
+		return checkFunc(node)
+	default:
+		return &TypeError{Pos: node.Position(), Msg: fmt.Sprintf("unknown node type %T", node)}
+	}
+}
+
+func checkBinary(node *parse.BinaryNode) error {
+	for _, a := range node.Args {
+		if err := check(a); err != nil {
+			return err
+		}
+	}
+	at, bt := node.Args[0].Return(), node.Args[1].Return()
+	switch at {
+	case parse.TYPE_SCALAR, parse.TYPE_NUMBER:
+		switch bt {
+		case parse.TYPE_SCALAR, parse.TYPE_NUMBER, parse.TYPE_SERIES:
+			return nil
+		}
+	case parse.TYPE_SERIES:
+		switch bt {
+		case parse.TYPE_SCALAR, parse.TYPE_NUMBER:
+			return nil
+		}
+	case parse.TYPE_STRING:
+		// Strings only support (in)equality, per operateString in
+		// expr.go - anything else (e.g. "a" + "b") is a static error.
+		if bt == parse.TYPE_STRING && (node.OpStr == "==" || node.OpStr == "!=") {
+			return nil
+		}
+	}
+	return &TypeError{
+		Pos: node.Position(),
+		Msg: fmt.Sprintf("invalid binary operands %v %s %v", at, node.OpStr, bt),
+	}
+}
+
+func checkUnary(node *parse.UnaryNode) error {
+	if err := check(node.Arg); err != nil {
+		return err
+	}
+	switch node.Arg.Return() {
+	case parse.TYPE_SCALAR, parse.TYPE_NUMBER, parse.TYPE_SERIES:
+		return nil
+	}
+	return &TypeError{
+		Pos: node.Position(),
+		Msg: fmt.Sprintf("invalid unary operand %v for %s", node.Arg.Return(), node.OpStr),
+	}
+}
+
+func checkFunc(node *parse.FuncNode) error {
+	if len(node.Args) != len(node.F.Args) {
+		return &TypeError{
+			Pos: node.Position(),
+			Msg: fmt.Sprintf("%s: expected %d args, got %d", node.String(), len(node.F.Args), len(node.Args)),
+		}
+	}
+	for i, a := range node.Args {
+		if err := check(a); err != nil {
+			return err
+		}
+		want := node.F.Args[i]
+		got := a.Return()
+		if want == got {
+			continue
+		}
+		// A scalar argument can be satisfied by a literal number, and a
+		// single-group scalar-typed series collapses via extractScalar at
+		// eval time, so number/scalar mismatches here are not fatal.
+		if want == parse.TYPE_SCALAR && got == parse.TYPE_NUMBER {
+			continue
+		}
+		// if()'s branches accept anything operate/union already know how
+		// to combine with a Series - the exact type is resolved per-group
+		// at eval time, same as a BinaryNode's Series operand.
+		if want == parse.TYPE_SERIES && (got == parse.TYPE_NUMBER || got == parse.TYPE_SCALAR) && isIf(node) {
+			continue
+		}
+		return &TypeError{
+			Pos: a.Position(),
+			Msg: fmt.Sprintf("%s: arg %d: expected %v, got %v", node.String(), i, want, got),
+		}
+	}
+	return nil
+}
+
+// isIf reports whether node calls the if() builtin.
+func isIf(node *parse.FuncNode) bool {
+	return node.F.F != nil && reflect.ValueOf(node.F.F).Pointer() == reflect.ValueOf(If).Pointer()
+}
@@ -0,0 +1,53 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/StackExchange/tsaf/expr/parse"
+)
+
+func strNode(s string) *parse.StringNode  { return &parse.StringNode{Text: s} }
+func numNode(f float64) *parse.NumberNode { return &parse.NumberNode{Float64: f} }
+
+// TestCheckBinaryStringEquality verifies that string == string and
+// string != string pass Check, and that string operators other than
+// ==/!= are still rejected.
+func TestCheckBinaryStringEquality(t *testing.T) {
+	eq := &parse.BinaryNode{Args: []parse.Node{strNode("web01"), strNode("web01")}, OpStr: "=="}
+	if err := checkBinary(eq); err != nil {
+		t.Fatalf("expected string == string to type-check, got %v", err)
+	}
+
+	ne := &parse.BinaryNode{Args: []parse.Node{strNode("a"), strNode("b")}, OpStr: "!="}
+	if err := checkBinary(ne); err != nil {
+		t.Fatalf("expected string != string to type-check, got %v", err)
+	}
+
+	gt := &parse.BinaryNode{Args: []parse.Node{strNode("a"), strNode("b")}, OpStr: ">"}
+	if err := checkBinary(gt); err == nil {
+		t.Fatal("expected string > string to be a static type error")
+	}
+}
+
+// TestCheckFuncLiteralSeriesArg verifies if(cond, 1, 0) - a literal number
+// standing in for a TYPE_SERIES branch - type-checks, matching the
+// wrap()/[]*Result conversion walkFunc now applies for such literals.
+func TestCheckFuncLiteralSeriesArg(t *testing.T) {
+	node := &parse.FuncNode{F: Builtins["if"], Args: []parse.Node{numNode(1), numNode(1), numNode(0)}}
+	if err := checkFunc(node); err != nil {
+		t.Fatalf("expected if(cond, 1, 0) to type-check, got %v", err)
+	}
+}
+
+// TestCheckFuncPointwiseCond verifies if(q(...) > x, a, b) type-checks:
+// cond's declared type is TYPE_SERIES precisely so a pointwise comparison
+// (itself TYPE_SERIES, per walkBinary's Series/Number case) is accepted,
+// not just a plain numeric condition.
+func TestCheckFuncPointwiseCond(t *testing.T) {
+	series := &parse.FuncNode{F: Builtins["q"], Args: []parse.Node{strNode("avg:cpu")}}
+	cmp := &parse.BinaryNode{Args: []parse.Node{series, numNode(80)}, OpStr: ">"}
+	node := &parse.FuncNode{F: Builtins["if"], Args: []parse.Node{cmp, numNode(1), numNode(0)}}
+	if err := check(node); err != nil {
+		t.Fatalf("expected if(series > x, a, b) to type-check, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package expr
+
+import (
+	"github.com/StackExchange/tsaf/third_party/github.com/MiniProfiler/go/miniprofiler"
+	"github.com/StackExchange/tsaf/third_party/github.com/StackExchange/scollector/opentsdb"
+)
+
+// DataSource abstracts the time-series backend an Expr is evaluated
+// against. state and the query builtins (q, band, avg, ...) talk to this
+// interface instead of opentsdb.Context directly, so the evaluator stays
+// agnostic to where the data actually comes from.
+type DataSource interface {
+	// Query runs req against the backend and returns one Group per tag
+	// group the backend split the response into (e.g. one per host for a
+	// host=* query). The returned opentsdb.Request is recorded in
+	// state.queries for the query log and UI; for non-OpenTSDB backends
+	// it is the closest OpenTSDB-shaped equivalent of what was actually
+	// run.
+	Query(T miniprofiler.Timer, req opentsdb.Request) ([]Group, opentsdb.Request, error)
+
+	// Describe returns a short, human readable name for the backend, used
+	// in error messages and the query listing UI.
+	Describe() string
+}
+
+// Group is one tag group's series, as split out of a DataSource response -
+// the per-host/per-group breakdown a query with a tag wildcard produces.
+type Group struct {
+	Series Series
+	Tags   opentsdb.TagSet
+}
+
+// openTSDBSource is the default DataSource, backed directly by an
+// opentsdb.Context. It preserves the exact behavior Expr.Execute had
+// before DataSource existed.
+type openTSDBSource struct {
+	c opentsdb.Context
+}
+
+// NewOpenTSDBSource wraps an opentsdb.Context as a DataSource.
+func NewOpenTSDBSource(c opentsdb.Context) DataSource {
+	return openTSDBSource{c: c}
+}
+
+func (o openTSDBSource) Describe() string {
+	return "opentsdb"
+}
+
+func (o openTSDBSource) Query(T miniprofiler.Timer, req opentsdb.Request) (groups []Group, sentReq opentsdb.Request, err error) {
+	var tr opentsdb.ResponseSet
+	T.Step("opentsdb query", func(miniprofiler.Timer) {
+		tr, err = o.c.Query(&req)
+	})
+	if err != nil {
+		return nil, req, err
+	}
+	for _, r := range tr {
+		s := make(Series)
+		for k, v := range r.DPS {
+			s[k] = v
+		}
+		groups = append(groups, Group{Series: s, Tags: r.Tags})
+	}
+	return groups, req, nil
+}
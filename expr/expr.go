@@ -6,6 +6,7 @@ import (
 	"math"
 	"reflect"
 	"runtime"
+	"sync"
 
 	"github.com/StackExchange/tsaf/expr/parse"
 	"github.com/StackExchange/tsaf/third_party/github.com/MiniProfiler/go/miniprofiler"
@@ -14,12 +15,19 @@ import (
 
 type state struct {
 	*Expr
-	context opentsdb.Context
-	queries []opentsdb.Request
+	context   DataSource
+	queries   []opentsdb.Request
+	queriesMu sync.Mutex
+
+	sem    chan struct{}
+	memo   map[string]*memoEntry
+	memoMu sync.Mutex
 }
 
 func (e *state) addRequest(r opentsdb.Request) {
+	e.queriesMu.Lock()
 	e.queries = append(e.queries, r)
+	e.queriesMu.Unlock()
 }
 
 var ErrUnknownOp = fmt.Errorf("expr: unknown op type")
@@ -40,16 +48,22 @@ func New(expr string) (*Expr, error) {
 	e := &Expr{
 		Tree: t,
 	}
+	if err := e.Check(); err != nil {
+		return nil, err
+	}
 	return e, nil
 }
 
-// Execute applies a parse expression to the specified OpenTSDB context,
-// and returns one result per group. T may be nil to ignore timings.
-func (e *Expr) Execute(c opentsdb.Context, T miniprofiler.Timer) (r []*Result, queries []opentsdb.Request, err error) {
+// Execute applies a parse expression against the given DataSource, and
+// returns one result per group. T may be nil to ignore timings. Pass
+// NewOpenTSDBSource(c) to evaluate against an opentsdb.Context as before.
+func (e *Expr) Execute(c DataSource, T miniprofiler.Timer) (r []*Result, queries []opentsdb.Request, err error) {
 	defer errRecover(&err)
 	s := &state{
 		Expr:    e,
 		context: c,
+		sem:     make(chan struct{}, maxParallelism),
+		memo:    make(map[string]*memoEntry),
 	}
 	if T == nil {
 		T = new(miniprofiler.Profile)
@@ -110,6 +124,12 @@ type Series map[string]opentsdb.Point
 func (s Series) Type() parse.FuncType { return parse.TYPE_SERIES }
 func (s Series) Value() interface{}   { return s }
 
+type String string
+
+func (s String) Type() parse.FuncType         { return parse.TYPE_STRING }
+func (s String) Value() interface{}           { return s }
+func (s String) MarshalJSON() ([]byte, error) { return json.Marshal(string(s)) }
+
 type Result struct {
 	Computations
 	Value
@@ -182,6 +202,8 @@ func (e *state) walk(node parse.Node, T miniprofiler.Timer) []*Result {
 	switch node := node.(type) {
 	case *parse.NumberNode:
 		return wrap(node.Float64)
+	case *parse.StringNode:
+		return []*Result{{Value: String(node.Text), Group: nil}}
 	case *parse.BinaryNode:
 		return e.walkBinary(node, T)
 	case *parse.UnaryNode:
@@ -194,8 +216,7 @@ func (e *state) walk(node parse.Node, T miniprofiler.Timer) []*Result {
 }
 
 func (e *state) walkBinary(node *parse.BinaryNode, T miniprofiler.Timer) []*Result {
-	ar := e.walk(node.Args[0], T)
-	br := e.walk(node.Args[1], T)
+	ar, br := e.walkChildren(node.Args[0], node.Args[1], T)
 	var res []*Result
 	u := union(ar, br)
 	for _, v := range u {
@@ -255,6 +276,15 @@ func (e *state) walkBinary(node *parse.BinaryNode, T miniprofiler.Timer) []*Resu
 			default:
 				panic(ErrUnknownOp)
 			}
+		case String:
+			switch bt := v.B.(type) {
+			case String:
+				n := Number(operateString(node.OpStr, string(at), string(bt)))
+				r.AddComputation(node.String(), n)
+				value = n
+			default:
+				panic(ErrUnknownOp)
+			}
 		default:
 			panic(ErrUnknownOp)
 		}
@@ -328,6 +358,25 @@ func operate(op string, a, b float64) (r float64) {
 	return
 }
 
+// operateString evaluates the (in)equality operators between two strings.
+// Strings only support == and != - anything else is a static error caught
+// by Expr.Check before this would ever run.
+func operateString(op string, a, b string) (r float64) {
+	switch op {
+	case "==":
+		if a == b {
+			r = 1
+		}
+	case "!=":
+		if a != b {
+			r = 1
+		}
+	default:
+		panic(fmt.Errorf("expr: unknown string operator %s", op))
+	}
+	return
+}
+
 func (e *state) walkUnary(node *parse.UnaryNode, T miniprofiler.Timer) []*Result {
 	a := e.walk(node.Arg, T)
 	for _, r := range a {
@@ -368,19 +417,28 @@ func uoperate(op string, a float64) (r float64) {
 func (e *state) walkFunc(node *parse.FuncNode, T miniprofiler.Timer) []*Result {
 	f := reflect.ValueOf(node.F.F)
 	var in []reflect.Value
-	for _, a := range node.Args {
+	for i, a := range node.Args {
 		var v interface{}
 		switch t := a.(type) {
 		case *parse.StringNode:
-			v = t.Text
+			if node.F.Args[i] == parse.TYPE_SERIES {
+				v = []*Result{{Value: String(t.Text)}}
+			} else {
+				v = t.Text
+			}
 		case *parse.NumberNode:
-			v = t.Float64
-		case *parse.FuncNode:
-			v = extractScalar(e.walkFunc(t, T))
-		case *parse.UnaryNode:
-			v = extractScalar(e.walkUnary(t, T))
-		case *parse.BinaryNode:
-			v = extractScalar(e.walkBinary(t, T))
+			if node.F.Args[i] == parse.TYPE_SERIES {
+				v = wrap(t.Float64)
+			} else {
+				v = t.Float64
+			}
+		case *parse.FuncNode, *parse.UnaryNode, *parse.BinaryNode:
+			res := e.walkMemo(t, T)
+			if node.F.Args[i] == parse.TYPE_SERIES {
+				v = res
+			} else {
+				v = extractScalar(res)
+			}
 		default:
 			panic(fmt.Errorf("expr: unknown func arg type"))
 		}
@@ -0,0 +1,237 @@
+package expr
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/StackExchange/tsaf/expr/parse"
+	"github.com/StackExchange/tsaf/third_party/github.com/MiniProfiler/go/miniprofiler"
+	"github.com/StackExchange/tsaf/third_party/github.com/StackExchange/scollector/opentsdb"
+)
+
+// Builtins is the set of functions callable from an alert expression. Each
+// entry's F is called with (*state, miniprofiler.Timer, ...) and must
+// return ([]*Result, error); Args and Return describe the static types
+// parse.Parse and Expr.Check use to validate a call before it ever runs.
+var Builtins = map[string]parse.Func{
+	"q": {
+		Args:   []parse.FuncType{parse.TYPE_STRING},
+		Return: parse.TYPE_SERIES,
+		F:      Query,
+	},
+	"band": {
+		Args:   []parse.FuncType{parse.TYPE_STRING, parse.TYPE_STRING, parse.TYPE_STRING, parse.TYPE_SCALAR},
+		Return: parse.TYPE_SERIES,
+		F:      Band,
+	},
+	"avg": {
+		Args:   []parse.FuncType{parse.TYPE_SERIES},
+		Return: parse.TYPE_NUMBER,
+		F:      Avg,
+	},
+	"change": {
+		Args:   []parse.FuncType{parse.TYPE_STRING, parse.TYPE_STRING, parse.TYPE_STRING},
+		Return: parse.TYPE_NUMBER,
+		F:      Change,
+	},
+	"if": {
+		// cond is declared TYPE_SERIES, not TYPE_NUMBER, so a pointwise
+		// comparison like q("avg:cpu") > 80 (itself TYPE_SERIES per
+		// walkBinary's Series/Number case) type-checks; a plain numeric
+		// condition still passes checkFunc's TYPE_SERIES/TYPE_NUMBER
+		// leniency.
+		Args:   []parse.FuncType{parse.TYPE_SERIES, parse.TYPE_SERIES, parse.TYPE_SERIES},
+		Return: parse.TYPE_SERIES,
+		F:      If,
+	},
+}
+
+// Query runs an ad-hoc OpenTSDB-style query string against e's DataSource
+// and returns the resulting series, one Result per tag group.
+func Query(e *state, T miniprofiler.Timer, query string) ([]*Result, error) {
+	req, err := opentsdb.ParseRequest(query)
+	if err != nil {
+		return nil, err
+	}
+	return e.query(T, req)
+}
+
+// Band queries the last num periods of duration dur for query, one series
+// per period, so callers can compare a metric against its recent history.
+func Band(e *state, T miniprofiler.Timer, query, duration, period string, num float64) ([]*Result, error) {
+	req, err := opentsdb.ParseRequest(query)
+	if err != nil {
+		return nil, err
+	}
+	dur, err := opentsdb.ParseDuration(duration)
+	if err != nil {
+		return nil, err
+	}
+	per, err := opentsdb.ParseDuration(period)
+	if err != nil {
+		return nil, err
+	}
+	var results []*Result
+	for i := 0; i < int(num); i++ {
+		r := *req
+		r.End = fmt.Sprintf("%ds-ago", int(time.Duration(i)*per/time.Second))
+		r.Start = fmt.Sprintf("%ds-ago", int((time.Duration(i)*per+dur)/time.Second))
+		rs, err := e.query(T, &r)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, rs...)
+	}
+	return results, nil
+}
+
+// query runs req against e.context, records it in e.queries, and returns
+// one Result per tag group the backend split the response into.
+func (e *state) query(T miniprofiler.Timer, req *opentsdb.Request) ([]*Result, error) {
+	groups, sent, err := e.context.Query(T, *req)
+	if err != nil {
+		return nil, err
+	}
+	e.addRequest(sent)
+	results := make([]*Result, 0, len(groups))
+	for _, g := range groups {
+		results = append(results, &Result{Value: g.Series, Group: g.Tags})
+	}
+	return results, nil
+}
+
+// Avg reduces each series in a to the mean of its points.
+func Avg(e *state, T miniprofiler.Timer, series []*Result) ([]*Result, error) {
+	for _, res := range series {
+		s := res.Value.(Series)
+		var total float64
+		for _, v := range s {
+			total += float64(v)
+		}
+		res.Value = Number(total / float64(len(s)))
+	}
+	return series, nil
+}
+
+// Change returns the difference between the average of the most recent
+// period and the one before it, expressed as a fraction of the prior value.
+func Change(e *state, T miniprofiler.Timer, query, duration, period string) ([]*Result, error) {
+	bandResults, err := Band(e, T, query, duration, period, 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(bandResults) != 2 {
+		return nil, fmt.Errorf("expr: change requires two periods of data")
+	}
+	recent, _ := Avg(e, T, bandResults[:1])
+	older, _ := Avg(e, T, bandResults[1:])
+	r0 := float64(recent[0].Value.(Number))
+	r1 := float64(older[0].Value.(Number))
+	return []*Result{{Value: Number((r0 - r1) / r1)}}, nil
+}
+
+// If implements the if(cond, a, b) builtin: for each group it evaluates
+// cond and returns a's value if non-zero, b's otherwise. If cond is itself
+// a Series, the selection is made pointwise, by timestamp. The cond ? a : b
+// ternary form is not implemented - there is no parser-level desugaring to
+// this builtin yet.
+func If(e *state, T miniprofiler.Timer, cond, a, b []*Result) ([]*Result, error) {
+	var res []*Result
+	for _, rc := range cond {
+		for _, rv := range matchBranch(rc, a, b) {
+			value, err := selectBranch(rc.Value, rv.a, rv.b)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, &Result{Group: rv.group, Value: value})
+		}
+	}
+	return res, nil
+}
+
+type branchPair struct {
+	group opentsdb.TagSet
+	a, b  Value
+}
+
+// matchBranch pairs a's and b's per-group values with rc's group, the same
+// subset/superset rule union uses for binary operators.
+func matchBranch(rc *Result, a, b []*Result) []branchPair {
+	var pairs []branchPair
+	for _, ra := range a {
+		if !groupsCompatible(rc.Group, ra.Group) {
+			continue
+		}
+		for _, rb := range b {
+			if !groupsCompatible(rc.Group, rb.Group) || !groupsCompatible(ra.Group, rb.Group) {
+				continue
+			}
+			g := widestGroup(rc.Group, ra.Group, rb.Group)
+			pairs = append(pairs, branchPair{group: g, a: ra.Value, b: rb.Value})
+		}
+	}
+	return pairs
+}
+
+func groupsCompatible(a, b opentsdb.TagSet) bool {
+	return a.Equal(b) || len(a) == 0 || len(b) == 0 || a.Subset(b) || b.Subset(a)
+}
+
+func widestGroup(gs ...opentsdb.TagSet) opentsdb.TagSet {
+	var widest opentsdb.TagSet
+	for _, g := range gs {
+		if len(g) > len(widest) {
+			widest = g
+		}
+	}
+	return widest
+}
+
+// selectBranch picks a or b according to cond, pointwise when cond (or the
+// branches) are Series.
+func selectBranch(cond Value, a, b Value) (Value, error) {
+	if cs, ok := cond.(Series); ok {
+		s := make(Series)
+		for k, cv := range cs {
+			chosen := a
+			if cv == 0 {
+				chosen = b
+			}
+			if v, ok := pointAt(chosen, k); ok {
+				s[k] = v
+			}
+		}
+		return s, nil
+	}
+	cv, ok := reflectFloat(cond)
+	if !ok {
+		return nil, fmt.Errorf("expr: if: condition must be numeric or a series")
+	}
+	if cv != 0 {
+		return a, nil
+	}
+	return b, nil
+}
+
+func pointAt(v Value, k string) (opentsdb.Point, bool) {
+	switch t := v.(type) {
+	case Series:
+		p, ok := t[k]
+		return p, ok
+	case Number:
+		return opentsdb.Point(t), true
+	case Scalar:
+		return opentsdb.Point(t), true
+	}
+	return 0, false
+}
+
+func reflectFloat(v Value) (float64, bool) {
+	switch t := v.(type) {
+	case Number:
+		return float64(t), true
+	case Scalar:
+		return float64(t), true
+	}
+	return 0, false
+}
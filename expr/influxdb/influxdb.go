@@ -0,0 +1,154 @@
+// Package influxdb implements expr.DataSource against an InfluxDB 0.9+
+// cluster, so alert expressions written against the q/band/avg/change
+// builtins can be evaluated without an OpenTSDB deployment.
+package influxdb
+
+import (
+	"fmt"
+	"strings"
+
+	influx "github.com/influxdb/influxdb/client"
+
+	"github.com/StackExchange/tsaf/expr"
+	"github.com/StackExchange/tsaf/third_party/github.com/MiniProfiler/go/miniprofiler"
+	"github.com/StackExchange/tsaf/third_party/github.com/StackExchange/scollector/opentsdb"
+)
+
+// Source is an expr.DataSource backed by InfluxDB. It translates the
+// opentsdb.Request built by the q/band/... builtins into an InfluxQL
+// SELECT and maps the resulting per-tag series back into an expr.Series.
+type Source struct {
+	Client   *influx.Client
+	Database string
+}
+
+// New returns a DataSource that queries db at addr.
+func New(addr, db, user, pass string) (*Source, error) {
+	c, err := influx.NewClient(influx.Config{
+		URL:      addr,
+		Username: user,
+		Password: pass,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Source{Client: c, Database: db}, nil
+}
+
+func (s *Source) Describe() string {
+	return "influxdb:" + s.Database
+}
+
+// Query translates req into InfluxQL, runs it, and converts the response
+// into one expr.Group per InfluxDB series (InfluxDB already splits a
+// GROUP BY tag query into one series per tag combination, same as
+// OpenTSDB's ResponseSet does per Response).
+func (s *Source) Query(T miniprofiler.Timer, req opentsdb.Request) (groups []expr.Group, sent opentsdb.Request, err error) {
+	var resp *influx.Response
+	ql := s.buildQuery(req)
+	T.Step("influxdb query", func(miniprofiler.Timer) {
+		resp, err = s.Client.Query(influx.Query{Command: ql, Database: s.Database})
+	})
+	if err != nil {
+		return nil, req, err
+	}
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			valueIdx := -1
+			for i, c := range row.Columns {
+				if c == "value" {
+					valueIdx = i
+				}
+			}
+			if valueIdx < 0 {
+				continue
+			}
+			series := make(expr.Series)
+			for _, v := range row.Values {
+				ts, val, err := parsePoint(v[0], v[valueIdx])
+				if err != nil {
+					continue
+				}
+				series[fmt.Sprintf("%d", ts)] = opentsdb.Point(val)
+			}
+			groups = append(groups, expr.Group{
+				Series: series,
+				Tags:   opentsdb.TagSet(row.Tags),
+			})
+		}
+	}
+	return groups, req, nil
+}
+
+// influxAggregators maps the OpenTSDB downsample aggregator names the
+// q/band/... builtins accept to their InfluxQL equivalents. OpenTSDB and
+// InfluxDB disagree on several common names (avg/mean, dev/stddev); an
+// aggregator missing from this table is passed through as-is.
+var influxAggregators = map[string]string{
+	"avg":   "mean",
+	"dev":   "stddev",
+	"sum":   "sum",
+	"min":   "min",
+	"max":   "max",
+	"count": "count",
+	"first": "first",
+	"last":  "last",
+}
+
+// buildQuery turns a single-metric OpenTSDB request into the InfluxQL
+// SELECT that evaluates the same downsample/aggregator/time range, grouped
+// by the query's tags.
+func (s *Source) buildQuery(req opentsdb.Request) string {
+	m := req.Queries[0]
+	agg := "mean"
+	interval := "1m"
+	if m.Downsample != "" {
+		if i := strings.Index(m.Downsample, "-"); i >= 0 {
+			interval = m.Downsample[:i]
+			agg = m.Downsample[i+1:]
+		}
+	}
+	if mapped, ok := influxAggregators[agg]; ok {
+		agg = mapped
+	}
+	where := []string{fmt.Sprintf("time > now() - %s", toInfluxDuration(req.Start))}
+	if req.End != "" {
+		where = append(where, fmt.Sprintf("time <= now() - %s", toInfluxDuration(req.End)))
+	}
+	for k, v := range m.Tags {
+		if v == "*" {
+			continue
+		}
+		where = append(where, fmt.Sprintf("%q = '%s'", k, v))
+	}
+	group := []string{fmt.Sprintf("time(%s)", interval)}
+	for k, v := range m.Tags {
+		if v == "*" {
+			group = append(group, fmt.Sprintf("%q", k))
+		}
+	}
+	return fmt.Sprintf("SELECT %s(value) FROM %q WHERE %s GROUP BY %s",
+		agg, m.Metric, strings.Join(where, " AND "), strings.Join(group, ", "))
+}
+
+// toInfluxDuration converts an OpenTSDB-style "N{s,m,h,d}-ago" start/end
+// time into the duration InfluxQL expects after "now() - ". An empty
+// OpenTSDB end (meaning "now") becomes "0s".
+func toInfluxDuration(ago string) string {
+	if ago == "" {
+		return "0s"
+	}
+	return strings.TrimSuffix(ago, "-ago")
+}
+
+func parsePoint(ts, val interface{}) (int64, float64, error) {
+	tsf, ok := ts.(float64)
+	if !ok {
+		return 0, 0, fmt.Errorf("influxdb: unexpected timestamp type %T", ts)
+	}
+	valf, ok := val.(float64)
+	if !ok {
+		return 0, 0, fmt.Errorf("influxdb: unexpected value type %T", val)
+	}
+	return int64(tsf), valf, nil
+}
@@ -0,0 +1,100 @@
+package influxdb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/StackExchange/tsaf/third_party/github.com/StackExchange/scollector/opentsdb"
+)
+
+func TestToInfluxDuration(t *testing.T) {
+	cases := map[string]string{
+		"1h-ago":  "1h",
+		"30s-ago": "30s",
+		"":        "0s",
+	}
+	for in, want := range cases {
+		if got := toInfluxDuration(in); got != want {
+			t.Errorf("toInfluxDuration(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParsePoint(t *testing.T) {
+	ts, val, err := parsePoint(float64(1234), float64(5.5))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ts != 1234 || val != 5.5 {
+		t.Fatalf("parsePoint = (%d, %v), want (1234, 5.5)", ts, val)
+	}
+
+	if _, _, err := parsePoint("not-a-number", float64(5.5)); err == nil {
+		t.Fatal("expected an error for a non-numeric timestamp")
+	}
+	if _, _, err := parsePoint(float64(1234), "not-a-number"); err == nil {
+		t.Fatal("expected an error for a non-numeric value")
+	}
+}
+
+func newReq(metric, downsample, start, end string, tags map[string]string) opentsdb.Request {
+	return opentsdb.Request{
+		Start: start,
+		End:   end,
+		Queries: []*opentsdb.Query{
+			{Metric: metric, Downsample: downsample, Tags: tags},
+		},
+	}
+}
+
+// TestBuildQueryAggregatorMapping guards the bug fixed in 022a958: OpenTSDB's
+// "avg" downsample must become InfluxQL's "mean", not pass through verbatim.
+func TestBuildQueryAggregatorMapping(t *testing.T) {
+	s := &Source{Database: "bosun"}
+	req := newReq("os.cpu", "1m-avg", "1h-ago", "", nil)
+	ql := s.buildQuery(req)
+	if !strings.Contains(ql, "mean(value)") {
+		t.Fatalf("expected avg downsample to translate to mean(), got: %s", ql)
+	}
+	if strings.Contains(ql, "avg(value)") {
+		t.Fatalf("InfluxQL has no avg() function, got: %s", ql)
+	}
+}
+
+// TestBuildQueryHonorsEnd guards the bug fixed in 022a958: band()'s
+// historical periods rely on req.End to bound each window, not just Start.
+func TestBuildQueryHonorsEnd(t *testing.T) {
+	s := &Source{Database: "bosun"}
+	req := newReq("os.cpu", "1m-avg", "2h-ago", "1h-ago", nil)
+	ql := s.buildQuery(req)
+	if !strings.Contains(ql, "time > now() - 2h") {
+		t.Fatalf("expected start bound in query, got: %s", ql)
+	}
+	if !strings.Contains(ql, "time <= now() - 1h") {
+		t.Fatalf("expected end bound in query, got: %s", ql)
+	}
+}
+
+func TestBuildQueryEndOmittedMeansNow(t *testing.T) {
+	s := &Source{Database: "bosun"}
+	req := newReq("os.cpu", "", "1h-ago", "", nil)
+	ql := s.buildQuery(req)
+	if strings.Contains(ql, "time <=") {
+		t.Fatalf("expected no upper time bound when End is empty, got: %s", ql)
+	}
+}
+
+func TestBuildQueryTagsAndWildcardGroup(t *testing.T) {
+	s := &Source{Database: "bosun"}
+	req := newReq("os.cpu", "", "1h-ago", "", map[string]string{"host": "*", "dc": "lax"})
+	ql := s.buildQuery(req)
+	if !strings.Contains(ql, `"dc" = 'lax'`) {
+		t.Fatalf("expected a fixed tag to appear in the WHERE clause, got: %s", ql)
+	}
+	if strings.Contains(ql, `"host" = '*'`) {
+		t.Fatalf("a wildcard tag must not be filtered in WHERE, got: %s", ql)
+	}
+	if !strings.Contains(ql, `GROUP BY time(1m), "host"`) {
+		t.Fatalf("expected the wildcard tag to be grouped on, got: %s", ql)
+	}
+}
@@ -0,0 +1,121 @@
+package expr
+
+import (
+	"github.com/StackExchange/tsaf/expr/parse"
+	"github.com/StackExchange/tsaf/third_party/github.com/MiniProfiler/go/miniprofiler"
+)
+
+// maxParallelism bounds how many subtrees of an expression are evaluated
+// concurrently. It exists so a pathological expression with hundreds of
+// independent q() calls can't open hundreds of simultaneous TSDB
+// connections. A var, not a const, so tests can shrink the pool to
+// exercise the case where a BinaryNode chain is deeper than the pool is
+// wide.
+var maxParallelism = 8
+
+// memoEntry holds the (possibly still-running) result of evaluating one
+// parse.Node, keyed by its canonical string form, so identical subtrees
+// (e.g. the same q(...) called from both sides of an &&) are only
+// evaluated once per Execute.
+type memoEntry struct {
+	done    chan struct{}
+	results []*Result
+	panic   interface{}
+}
+
+// walkMemo evaluates node at most once per Execute: the first caller to
+// reach a given subtree runs it, concurrently with its siblings, and every
+// later caller with the same canonical subtree blocks on and reuses that
+// result instead of re-running it. If the evaluating goroutine panics
+// (e.g. errRecover's error path), the panic is recorded on the entry and
+// re-raised in every goroutine waiting on it, rather than leaving them
+// blocked forever.
+func (e *state) walkMemo(node parse.Node, T miniprofiler.Timer) []*Result {
+	key := node.String()
+	e.memoMu.Lock()
+	entry, ok := e.memo[key]
+	if !ok {
+		entry = &memoEntry{done: make(chan struct{})}
+		e.memo[key] = entry
+	}
+	e.memoMu.Unlock()
+	if ok {
+		<-entry.done
+		if entry.panic != nil {
+			panic(entry.panic)
+		}
+		return entry.results
+	}
+	defer close(entry.done)
+	defer func() {
+		if r := recover(); r != nil {
+			entry.panic = r
+			panic(r)
+		}
+	}()
+	entry.results = e.walk(node, T)
+	return entry.results
+}
+
+// walkChildren evaluates a and b, the two operands of a BinaryNode. Results
+// are memoized by walkMemo, so identical operands (whether they're a and b
+// themselves, or subtrees shared with other parts of the expression) are
+// computed once and reused. a always runs on this goroutine; b is given its
+// own goroutine only if a worker slot is immediately available, otherwise
+// it also runs on this goroutine, so a deeply nested expression can never need more slots than
+// it has live goroutines waiting on children, which would deadlock a
+// bounded pool. A panic in either branch is re-raised on this goroutine
+// once both branches finish.
+//
+// b's branch is walked under its own T.Step child timer, minted here on
+// the calling goroutine before the worker starts, rather than letting the
+// spawned goroutine call T.Step on the shared parent T concurrently with
+// a's evaluation below. That preserves T.Step's existing nesting while
+// avoiding two goroutines driving the same Timer at once.
+func (e *state) walkChildren(a, b parse.Node, T miniprofiler.Timer) (ar, br []*Result) {
+	type outcome struct {
+		res   []*Result
+		panic interface{}
+	}
+	done := make(chan struct{})
+	var bOut outcome
+	runB := func(childT miniprofiler.Timer) {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				bOut.panic = r
+			}
+		}()
+		bOut.res = e.walkMemo(b, childT)
+	}
+	select {
+	case e.sem <- struct{}{}:
+		T.Step("parallel operand", func(childT miniprofiler.Timer) {
+			go func() {
+				defer func() { <-e.sem }()
+				runB(childT)
+			}()
+		})
+	default:
+		T.Step("operand", func(childT miniprofiler.Timer) {
+			runB(childT)
+		})
+	}
+	var aOut outcome
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				aOut.panic = r
+			}
+		}()
+		aOut.res = e.walkMemo(a, T)
+	}()
+	<-done
+	if aOut.panic != nil {
+		panic(aOut.panic)
+	}
+	if bOut.panic != nil {
+		panic(bOut.panic)
+	}
+	return aOut.res, bOut.res
+}
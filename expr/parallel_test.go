@@ -0,0 +1,113 @@
+package expr
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/StackExchange/tsaf/expr/parse"
+	"github.com/StackExchange/tsaf/third_party/github.com/MiniProfiler/go/miniprofiler"
+)
+
+func newTestState() *state {
+	return &state{
+		sem:  make(chan struct{}, maxParallelism),
+		memo: make(map[string]*memoEntry),
+	}
+}
+
+// chain builds a left-leaning tree of n nested "+" BinaryNodes, so
+// walkChildren recurses n levels deep evaluating the left operand.
+func chain(n int) parse.Node {
+	var node parse.Node = &parse.NumberNode{Float64: 1}
+	for i := 0; i < n; i++ {
+		node = &parse.BinaryNode{
+			Args:  []parse.Node{node, &parse.NumberNode{Float64: 1}},
+			OpStr: "+",
+		}
+	}
+	return node
+}
+
+// TestWalkChildrenDeepChainDoesNotDeadlock guards against the bug fixed in
+// the same series: walkChildren used to block acquiring a semaphore slot
+// for a child while still holding its own slot, so a BinaryNode chain
+// deeper than maxParallelism hung forever. With the pool shrunk to 1, a
+// chain of depth 4 reproduces that depth-over-width condition.
+func TestWalkChildrenDeepChainDoesNotDeadlock(t *testing.T) {
+	old := maxParallelism
+	maxParallelism = 1
+	defer func() { maxParallelism = old }()
+
+	e := &state{
+		Expr: &Expr{},
+		sem:  make(chan struct{}, maxParallelism),
+		memo: make(map[string]*memoEntry),
+	}
+	node := chain(4)
+
+	done := make(chan []*Result, 1)
+	go func() {
+		done <- e.walk(node, new(miniprofiler.Profile))
+	}()
+
+	select {
+	case res := <-done:
+		if len(res) != 1 || res[0].Value.(Scalar) != 5 {
+			t.Fatalf("unexpected result: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("walk deadlocked on a BinaryNode chain deeper than maxParallelism")
+	}
+}
+
+// TestWalkMemoDedupes verifies two occurrences of the same canonical
+// subtree are only evaluated once per Execute.
+func TestWalkMemoDedupes(t *testing.T) {
+	e := newTestState()
+	e.Expr = &Expr{}
+	node := &parse.NumberNode{Float64: 42}
+
+	a := e.walkMemo(node, new(miniprofiler.Profile))
+	b := e.walkMemo(node, new(miniprofiler.Profile))
+	if len(a) != 1 || len(b) != 1 || a[0] != b[0] {
+		t.Fatalf("expected the second call to reuse the first's Result, got %v vs %v", a, b)
+	}
+	if len(e.memo) != 1 {
+		t.Fatalf("expected exactly one memo entry, got %d", len(e.memo))
+	}
+}
+
+// TestWalkMemoPropagatesPanic verifies a panic while evaluating a
+// memoized subtree is re-raised in every goroutine waiting on it, instead
+// of leaving them blocked on memoEntry.done forever.
+func TestWalkMemoPropagatesPanic(t *testing.T) {
+	e := newTestState()
+	e.Expr = &Expr{}
+	node := &parse.UnaryNode{Arg: &parse.NumberNode{Float64: 1}, OpStr: "bogus"}
+
+	done := make(chan string, 2)
+	run := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Sprint(r)
+				return
+			}
+			done <- ""
+		}()
+		e.walkMemo(node, new(miniprofiler.Profile))
+	}
+	go run()
+	go run()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-done:
+			if msg == "" {
+				t.Fatal("expected panic to propagate, got none")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("goroutine waiting on a panicking memo entry never returned")
+		}
+	}
+}